@@ -0,0 +1,81 @@
+// Copyright (c) 2015-2021 MinIO, Inc.
+//
+// This file is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/minio/pkg/bucket/policy"
+)
+
+func TestEvaluatePolicyRequest(t *testing.T) {
+	const bucket = "test-bucket"
+	p, err := policy.ParseConfig(strings.NewReader(`{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Principal": {"AWS": ["did:example:reader"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+			},
+			{
+				"Effect": "Deny",
+				"Principal": {"AWS": ["did:example:blocked"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+			}
+		]
+	}`), bucket)
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		principal string
+		want      string
+	}{
+		{"allowed reader", "did:example:reader", "Allow"},
+		{"explicitly denied principal", "did:example:blocked", "Deny"},
+		{"unrelated principal defaults to deny", "did:example:other", "Deny"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := policySimulationRequest{
+				Bucket:    bucket,
+				Principal: tt.principal,
+				Action:    "s3:GetObject",
+				Resource:  bucket + "/report.csv",
+			}
+			got := evaluatePolicyRequest(p, req)
+			if got.Effect != tt.want {
+				t.Errorf("Effect = %s, want %s", got.Effect, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatePolicyRequestNilPolicy(t *testing.T) {
+	got := evaluatePolicyRequest(nil, policySimulationRequest{})
+	if got.Effect != "Deny" {
+		t.Errorf("Effect = %s, want Deny for a nil policy", got.Effect)
+	}
+}
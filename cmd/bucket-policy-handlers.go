@@ -23,7 +23,6 @@ import (
 	"encoding/json"
 	"fmt"
 	humanize "github.com/dustin/go-humanize"
-	"github.com/minio/madmin-go/v3"
 	"github.com/minio/minio/internal/logger"
 	"github.com/minio/mux"
 	"github.com/minio/pkg/bucket/policy"
@@ -31,6 +30,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -39,8 +40,44 @@ const (
 
 	// Policy configuration file.
 	bucketPolicyConfig = "policy.json"
+
+	// How long to wait before re-evaluating a statement whose condition keys
+	// (e.g. a not-yet-reached aws:CurrentTime bound) didn't match at apply
+	// time, so the grant it describes is eventually applied instead of being
+	// silently dropped.
+	permissionRecheckInterval = 5 * time.Minute
 )
 
+// saoPermissionDelta is the result of translating one object's worth of
+// bucket-policy statements into the SAO permission model. A nil/zero-value
+// delta for an object that previously had one means the grant was revoked.
+type saoPermissionDelta struct {
+	// public, when true, means the object should be granted via
+	// SaoClient.SetPublicPermission instead of an explicit reader/writer list.
+	public bool
+
+	// readers/writers are DID/wallet principals resolved from the policy,
+	// deduplicated, with any explicitly Denied principal removed.
+	readers []string
+	writers []string
+}
+
+// empty reports whether the delta grants nothing at all, in which case the
+// object's permissions should be cleared rather than updated.
+func (d *saoPermissionDelta) empty() bool {
+	return d == nil || (!d.public && len(d.readers) == 0 && len(d.writers) == 0)
+}
+
+// MarshalJSON encodes the delta's grant (public flag and reader/writer
+// principals) for the policy simulator response and the policy audit log.
+func (d *saoPermissionDelta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Public  bool     `json:"public"`
+		Readers []string `json:"readers,omitempty"`
+		Writers []string `json:"writers,omitempty"`
+	}{d.public, d.readers, d.writers})
+}
+
 // PutBucketPolicyHandler - This HTTP handler stores given bucket policy configuration as per
 // https://docs.aws.amazon.com/AmazonS3/latest/dev/access-policy-language-overview.html
 func (api objectAPIHandlers) PutBucketPolicyHandler(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +96,9 @@ func (api objectAPIHandlers) PutBucketPolicyHandler(w http.ResponseWriter, r *ht
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
 
+	audit := newPolicyAuditEvent(bucket, actorDIDFromRequest(r))
+	defer audit.emitUnlessDeferred(ctx)
+
 	if s3Error := checkRequestAuthType(ctx, r, policy.PutBucketPolicyAction, bucket, ""); s3Error != ErrNone {
 		writeErrorResponse(ctx, w, errorCodes.ToAPIErr(s3Error), r.URL)
 		return
@@ -99,231 +139,609 @@ func (api objectAPIHandlers) PutBucketPolicyHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	extractObjectNames := func(bucketPolicy *policy.Policy) []string {
-		var objectNames []string
-		for _, statement := range bucketPolicy.Statements {
-			if statement.Effect == "Allow" {
-				for principal := range statement.Principal.AWS {
-					if principal == "*" {
-						if _, ok := statement.Actions[policy.GetObjectAction]; ok {
-							for resource := range statement.Resources {
-								objectName := resource.Pattern
-								// Remove the bucket prefix if present
-								if strings.Contains(objectName, "/") {
-									objectName = strings.SplitN(objectName, "/", 2)[1]
-								} else if objectName == bucket {
-									// If the resource is the bucket itself, skip it
-									continue
-								}
-								objectNames = append(objectNames, objectName)
-							}
-						}
-					}
-				}
-			}
-		}
-		return objectNames
+	// Version in policy must not be empty. Check this, and marshal below,
+	// before anything touches SAO permissions - a policy that never
+	// validates must never mutate a single object's grants.
+	if bucketPolicy.Version == "" {
+		writeErrorResponse(ctx, w, errorCodes.ToAPIErr(ErrPolicyInvalidVersion), r.URL)
+		return
 	}
 
+	// Marshal the bucket policy to JSON
+	jsonData, err := json.Marshal(bucketPolicy)
+	if err != nil {
+		logger.Error("Error marshaling bucket policy", zap.Error(err))
+		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
+		return
+	}
+	audit.NewPolicyHash = hashPolicyBytes(jsonData)
+
 	// Read bucket access policy.
-	var originalBucketPolicy *policy.Policy
-	modelKey := fmt.Sprintf("%s-%s-%s", api.DidManagerId, "minio_bucket_policy", bucket)
-	modelExists := false
-	var content []byte
-	modelResponse, err := api.SaoClient.GetModel(ctx, modelKey)
-	if err == nil {
-		dataId := modelResponse.Model.Data
-		content, err = api.SaoClient.Load(ctx, dataId, "", "", bucket)
-		if err == nil {
-			err = json.Unmarshal(content, &originalBucketPolicy)
-			modelExists = true
+	effective, err := api.fetchEffectiveBucketPolicy(ctx, bucket)
+	if effective.SaoErr != nil {
+		logger.Info("Unable to read original bucket policy from SAO", zap.Error(effective.SaoErr))
+		if strings.Contains(effective.SaoErr.Error(), "no route to host") {
+			writeErrorResponse(ctx, w, toAPIError(ctx, effective.SaoErr), r.URL)
+			return
 		}
 	}
 
-	// If the model doesn't exist, read the policy from local server
+	audit.SaoDataIDBefore = effective.SaoModelDataId
+	audit.PriorPolicyHash = hashPolicyBytes(effective.RawContent)
+
+	originalBucketPolicy := effective.Policy
+	var permissionDeltas, originalDeltas map[string]*saoPermissionDelta
 	if err != nil {
-		logger.Info("Unable to read original bucket policy from SAO", zap.Error(err))
-		if strings.Contains(err.Error(), "no route to host") {
-			writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-			return
-		}
+		logger.Error("Unable to read original bucket policy", zap.Error(err))
+		permissionDeltas = api.translateBucketPolicyToSaoPermissions(ctx, bucketPolicy, bucket)
+	} else if originalBucketPolicy != nil {
+		// Translate both policies to their SAO reader/writer grants and only push
+		// the objects whose effective grant actually changed. originalDeltas
+		// doubles as the compensation set: if the permission job started below
+		// doesn't fully succeed, it's what every successfully-changed object is
+		// reverted back to.
+		originalDeltas = api.translateBucketPolicyToSaoPermissions(ctx, originalBucketPolicy, bucket)
+		newDeltas := api.translateBucketPolicyToSaoPermissions(ctx, bucketPolicy, bucket)
+		permissionDeltas = diffPermissionDeltas(newDeltas, originalDeltas)
+	}
 
-		originalBucketPolicy, err = globalPolicySys.Get(bucket)
-		if err != nil {
-			logger.Error("Unable to read original bucket policy", zap.Error(err))
-			newObjectNames := extractObjectNames(bucketPolicy)
-			api.updateObjectPermissions(ctx, newObjectNames, bucket, true)
-		}
+	// Commit the policy document itself first. Only once it's durably in
+	// place - SAO model and local metadata both - do we start mutating any
+	// object's SAO permissions; a version/marshal/commit failure above or
+	// here must never leave a single object touched.
+	txn := newBucketPolicyTxn(api, bucket, effective.SaoModelExists, effective.SaoModelDataId, effective.RawContent)
+	_, saoDataId, err := txn.commitPut(ctx, jsonData, bucketPolicyBytes)
+	if err != nil {
+		logger.Error("Error committing bucket policy", zap.Error(err))
+		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
+		return
+	}
+	audit.SaoDataIDAfter = saoDataId
+	audit.Outcome = "ok"
+
+	// Offload the (potentially huge) SAO permission fan-out to a background
+	// job instead of blocking this request on thousands of serial SAO calls;
+	// the client polls PolicyJobStatusHandler for per-object completion. If
+	// the job doesn't fully succeed, it compensates by reverting whatever it
+	// did manage to change back to originalDeltas, so a partial failure can't
+	// leave some objects on the new policy's grants and others on the old one.
+	// The job takes ownership of audit and emits it itself once Objects is
+	// known, so the deferred emitUnlessDeferred above becomes a no-op.
+	if len(permissionDeltas) > 0 {
+		job := txn.startPermissionJob(audit, permissionDeltas, originalDeltas)
+		w.Header().Set("X-Minio-Sao-Policy-Job-Id", job.ID)
 	}
+	audit.tagRequestAuditInfo(ctx)
 
-	if originalBucketPolicy != nil {
-		// Extract object names from a policy
-		originalObjectNames := extractObjectNames(originalBucketPolicy)
-		newObjectNames := extractObjectNames(bucketPolicy)
+	// Success.
+	writeSuccessNoContent(w)
+}
 
-		// Find added and removed object names
-		addedObjectNames := difference(newObjectNames, originalObjectNames)
-		removedObjectNames := difference(originalObjectNames, newObjectNames)
+// effectiveBucketPolicy is the result of fetchEffectiveBucketPolicy: the
+// policy currently in effect for a bucket, plus enough of the SAO model's
+// identity to update or roll it back.
+type effectiveBucketPolicy struct {
+	Policy *policy.Policy
+
+	// SaoModelExists/SaoModelDataId/RawContent describe the SAO-backed
+	// policy model, when one was found.
+	SaoModelExists bool
+	SaoModelDataId string
+	RawContent     []byte
+
+	// SaoErr is the error (if any) hit while reading the SAO model, kept
+	// around so callers can special-case errors like "no route to host"
+	// even when the local-metadata fallback below succeeded.
+	SaoErr error
+}
 
-		api.updateObjectPermissions(ctx, addedObjectNames, bucket, true)
-		api.updateObjectPermissions(ctx, removedObjectNames, bucket, false)
-	}
+// fetchEffectiveBucketPolicy loads the policy currently in effect for a
+// bucket, preferring the SAO-backed model and falling back to local bucket
+// metadata. Both PutBucketPolicyHandler (to diff against the incoming
+// policy) and the policy simulator (to evaluate requests against "what's
+// live now") go through this one path so they never see a different
+// "current" policy.
+func (api objectAPIHandlers) fetchEffectiveBucketPolicy(ctx context.Context, bucket string) (*effectiveBucketPolicy, error) {
+	modelKey := fmt.Sprintf("%s-%s-%s", api.DidManagerId, "minio_bucket_policy", bucket)
 
-	// Version in policy must not be empty
-	if bucketPolicy.Version == "" {
-		writeErrorResponse(ctx, w, errorCodes.ToAPIErr(ErrPolicyInvalidVersion), r.URL)
-		return
+	modelResponse, saoErr := api.SaoClient.GetModel(ctx, modelKey)
+	if saoErr == nil {
+		dataId := modelResponse.Model.Data
+		var content []byte
+		content, saoErr = api.SaoClient.Load(ctx, dataId, "", "", bucket)
+		if saoErr == nil {
+			var p policy.Policy
+			if saoErr = json.Unmarshal(content, &p); saoErr == nil {
+				return &effectiveBucketPolicy{
+					Policy:         &p,
+					SaoModelExists: true,
+					SaoModelDataId: dataId,
+					RawContent:     content,
+				}, nil
+			}
+		}
 	}
 
-	configData, err := json.Marshal(bucketPolicy)
+	// SAO model is missing or unreadable, fall back to local bucket metadata.
+	p, err := globalPolicySys.Get(bucket)
 	if err != nil {
-		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-		return
+		return &effectiveBucketPolicy{SaoErr: saoErr}, err
 	}
+	return &effectiveBucketPolicy{Policy: p, SaoErr: saoErr}, nil
+}
 
-	// Marshal the bucket policy to JSON
-	jsonData, err := json.Marshal(bucketPolicy)
-	if err != nil {
-		logger.Error("Error marshaling bucket policy", zap.Error(err))
-		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-		return
+// updateObjectPermissions pushes every object's resolved saoPermissionDelta
+// down to SAO through a bounded pool of saoPermissionWorkerCount workers, so
+// a policy touching thousands of objects doesn't serialize thousands of SAO
+// round trips onto the calling goroutine. Returns one policyAuditObjectChange
+// per object, plus a MultiError collecting every object's failure (empty, so
+// its ErrorOrNil returns nil, if every object applied cleanly).
+func (api objectAPIHandlers) updateObjectPermissions(ctx context.Context, bucket string, deltas map[string]*saoPermissionDelta) ([]policyAuditObjectChange, *MultiError) {
+	type permissionJob struct {
+		objectName string
+		delta      *saoPermissionDelta
 	}
 
-	if modelExists {
-		// Model exists, update it
+	jobs := make(chan permissionJob)
+	results := make(chan policyAuditObjectChange, len(deltas))
 
-		// print jsonData
-		logger.Info("jsonData", zap.String("jsonData", string(jsonData)))
-		// print content
-		logger.Info("original content", zap.String("content", string(content)))
+	workers := saoPermissionWorkerCount()
+	if workers > len(deltas) {
+		workers = len(deltas)
+	}
+	if workers < 1 {
+		workers = 1
+	}
 
-		//print modelResponse.Model.Data
-		logger.Info("modelResponse.Model.Data", zap.String("modelResponse.Model.Data", modelResponse.Model.Data))
-		err := api.SaoClient.UpdateModelQuick(ctx, modelResponse.Model.Data, jsonData, bucket, 365, 30, false, 1)
-		if err != nil {
-			if strings.Contains(err.Error(), "No differences found") {
-				logger.Info("No differences found, model not updated")
-			} else {
-				logger.Error("Error updating model for bucket policy", zap.Error(err))
-				writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-				return
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- api.applyObjectPermission(ctx, bucket, j.objectName, j.delta)
+			}
+		}()
+	}
+
+	go func() {
+		for objectName, delta := range deltas {
+			if objectName == "*" {
+				// objectNamesFromResources expands every wildcard resource
+				// pattern against the bucket's real objects before deltas are
+				// built, so a literal "*" key should never reach here; guard
+				// against it anyway rather than sending a bogus SAO lookup.
+				logger.Error("updateObjectPermissions: unexpected literal \"*\" object name, dropping", zap.String("bucket", bucket))
+				continue
 			}
-		} else {
-			logger.Info("Bucket policy model updated")
+			jobs <- permissionJob{objectName: objectName, delta: delta}
 		}
-	} else {
-		// Create a new model for the bucket policy using the SAO client
-		_, dataId, err := api.SaoClient.CreateModel(ctx, string(jsonData), bucket, 365, 30, "minio_bucket_policy", 1, false)
-		if err != nil {
-			logger.Error("Error creating model for bucket policy", zap.Error(err))
-			writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-			return
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	changes := make([]policyAuditObjectChange, 0, len(deltas))
+	errs := &MultiError{}
+	for change := range results {
+		if change.Outcome != "ok" {
+			errs.Add(fmt.Errorf("%s: %s", change.ObjectName, change.Outcome))
 		}
-		logger.Info("Bucket policy model created", zap.String("dataId", dataId))
+		changes = append(changes, change)
 	}
 
-	updatedAt, err := globalBucketMetadataSys.Update(ctx, bucket, bucketPolicyConfig, configData)
-	if err != nil {
-		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
-		return
+	return changes, errs
+}
+
+// applyObjectPermission pushes one object's resolved saoPermissionDelta down
+// to SAO, touching both the file_ and _info models that back it, retrying
+// each SAO call a few times with a short backoff before giving up on the
+// object.
+func (api objectAPIHandlers) applyObjectPermission(ctx context.Context, bucket, objectName string, delta *saoPermissionDelta) policyAuditObjectChange {
+	if delta.empty() {
+		logger.Info("Object removed from public read access", zap.String("objectName", objectName))
+	} else if delta.public {
+		logger.Info("New object made publicly readable", zap.String("objectName", objectName))
+	} else {
+		logger.Info("Object grant updated", zap.String("objectName", objectName))
 	}
 
-	// Call site replication hook.
-	logger.LogIf(ctx, globalSiteReplicationSys.BucketMetaHook(ctx, madmin.SRBucketMeta{
-		Type:      madmin.SRBucketMetaTypePolicy,
-		Bucket:    bucket,
-		Policy:    bucketPolicyBytes,
-		UpdatedAt: updatedAt,
-	}))
+	change := policyAuditObjectChange{ObjectName: objectName, PermissionDelta: delta}
 
-	// Success.
-	writeSuccessNoContent(w)
+	for _, suffix := range []string{"file_" + objectName, objectName + "_info"} {
+		var dataId string
+		err := withObjectPermissionRetry(func() error {
+			var fetchErr error
+			dataId, fetchErr = api.fetchSaoDataId(ctx, api.DidManagerId, suffix, bucket)
+			return fetchErr
+		})
+		if err != nil {
+			logger.Error("fetchSaoDataId error", zap.String("objectName", objectName), zap.Error(err))
+			change.Outcome = err.Error()
+			return change
+		}
+		change.SaoDataID = dataId
+
+		err = withObjectPermissionRetry(func() error {
+			if delta.public {
+				return api.SaoClient.SetPublicPermission(ctx, dataId)
+			}
+			return api.SaoClient.UpdatePermission(ctx, dataId, delta.readers, delta.writers)
+		})
+		if err != nil {
+			logger.Error("Error updating SAO object permission", zap.String("objectName", objectName), zap.Error(err))
+			change.Outcome = err.Error()
+			return change
+		}
+	}
+
+	change.Outcome = "ok"
+	return change
 }
 
-func (api objectAPIHandlers) updateObjectPermissions(ctx context.Context, objectNames []string, bucket string, addPermission bool) {
-	if !addPermission && contains(objectNames, "*") {
-		logger.Info("Don't remove public read access from all objects in bucket")
-		return
+// translateBucketPolicyToSaoPermissions walks every statement of a bucket
+// policy and resolves the SAO reader/writer grant each object in the bucket
+// ends up with. Statements are evaluated in order, Allow building up a grant
+// and Deny always winning regardless of position, matching the usual AWS
+// policy evaluation semantics.
+func (api objectAPIHandlers) translateBucketPolicyToSaoPermissions(ctx context.Context, bucketPolicy *policy.Policy, bucket string) map[string]*saoPermissionDelta {
+	deltas := map[string]*saoPermissionDelta{}
+
+	grant := func(objectName string) *saoPermissionDelta {
+		d, ok := deltas[objectName]
+		if !ok {
+			d = &saoPermissionDelta{}
+			deltas[objectName] = d
+		}
+		return d
 	}
 
-nextObjectName:
-	for _, objectName := range objectNames {
-		if objectName == "*" {
-			logger.Info("* is not supported")
+	denied := map[string]map[string]bool{} // objectName -> principal -> denied
+
+	for _, statement := range bucketPolicy.Statements {
+		objectNames := objectNamesFromResources(ctx, api, statement, bucket)
+		if len(objectNames) == 0 {
 			continue
 		}
 
-		if addPermission {
-			logger.Info("New object made publicly readable: %s\n", objectName)
-		} else {
-			logger.Info("Object removed from public read access: %s\n", objectName)
+		principals := statementPrincipals(statement)
+		read, write := statementActionKinds(statement)
+		if !read && !write {
+			continue
 		}
 
-		for _, suffix := range []string{"file_" + objectName, objectName + "_info"} {
-			dataId, err := api.fetchSaoDataId(ctx, api.DidManagerId, suffix, bucket)
-			if err != nil {
-				logger.Error("fetchSaoDataId error: %s\n", err.Error())
-				continue nextObjectName
-			}
+		for _, objectName := range objectNames {
+			for _, principal := range principals {
+				// Evaluate the statement's condition keys before anything
+				// else: a condition gating a Deny (e.g. aws:SourceIp) must
+				// hold before the Deny is enforced, and a condition gating a
+				// public ("*") Allow (e.g. a time-bounded grant) must hold
+				// before public access is granted, the same as it would for
+				// a named principal.
+				if !statementConditionSatisfied(api, bucket, statement, principal) {
+					continue
+				}
 
-			if addPermission {
-				err = api.SaoClient.SetPublicPermission(ctx, dataId)
-				if err != nil {
-					logger.Error("SetPublicPermission error: %s\n", err.Error())
-					continue nextObjectName
+				if statement.Effect == "Deny" {
+					if denied[objectName] == nil {
+						denied[objectName] = map[string]bool{}
+					}
+					denied[objectName][principal] = true
+					continue
 				}
-			} else {
-				err = api.SaoClient.UpdatePermission(ctx, dataId, []string{}, []string{})
-				if err != nil {
-					logger.Error("SetPublicPermission error: %s\n", err.Error())
-					continue nextObjectName
+
+				if statement.Effect != "Allow" {
+					continue
+				}
+
+				if principal == "*" {
+					grant(objectName).public = true
+					continue
+				}
+
+				d := grant(objectName)
+				if read {
+					d.readers = appendUnique(d.readers, principal)
+				}
+				if write {
+					d.writers = appendUnique(d.writers, principal)
 				}
 			}
 		}
 	}
+
+	// Explicit Deny always overrides any Allow for the same principal/object.
+	for objectName, deniedPrincipals := range denied {
+		d, ok := deltas[objectName]
+		if !ok {
+			continue
+		}
+		if deniedPrincipals["*"] {
+			deltas[objectName] = &saoPermissionDelta{}
+			continue
+		}
+		d.readers = removeAll(d.readers, deniedPrincipals)
+		d.writers = removeAll(d.writers, deniedPrincipals)
+	}
+
+	return deltas
 }
 
-func (api objectAPIHandlers) fetchSaoDataId(ctx context.Context, didManagerId, object, bucket string) (string, error) {
-	modelKey := fmt.Sprintf("%s-%s-%s", didManagerId, object, bucket)
-	logger.Info("modelKey: ", modelKey)
-	// Call saoClient.GetModel() to get the dataId
-	modelResponse, err := api.SaoClient.GetModel(ctx, modelKey)
-	if err != nil {
-		logger.Error("Failed to fetch sao data Id", zap.Error(err))
-		return "", err
+// statementConditionSatisfied evaluates the condition keys this package
+// understands (aws:CurrentTime, StringEquals on aws:userid) for one
+// candidate principal. If the condition references a time bound that hasn't
+// been reached yet, the grant isn't dropped: a recheck is scheduled so it
+// still takes effect once the bound passes.
+func statementConditionSatisfied(api objectAPIHandlers, bucket string, statement policy.Statement, principal string) bool {
+	values := map[string][]string{
+		"aws:CurrentTime": {time.Now().UTC().Format(time.RFC3339)},
+		"aws:userid":      {principal},
 	}
 
-	logger.Info(modelResponse.Model.Data)
+	if statement.Conditions.Evaluate(values) {
+		return true
+	}
 
-	// Return the dataId from the modelResponse
-	return modelResponse.Model.Data, nil
+	api.schedulePermissionRecheck(bucket)
+	return false
 }
 
-// Utility function to check if a slice contains a specific string
-func contains(slice []string, str string) bool {
-	for _, v := range slice {
-		if v == str {
-			return true
+// permissionRecheckScheduler dedups schedulePermissionRecheck: a bucket-wide
+// conditional statement evaluated across many objects and principals in a
+// single translateBucketPolicyToSaoPermissions call would otherwise call
+// schedulePermissionRecheck once per failing (object, principal) pair, and
+// every subsequent PutBucketPolicy on the same bucket would schedule a fresh
+// batch on top regardless of whether earlier ones had fired yet. This caps
+// it at one pending recheck per bucket at a time.
+type permissionRecheckScheduler struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+var globalPermissionRechecks = &permissionRecheckScheduler{pending: map[string]bool{}}
+
+// scheduleIfNotPending arranges for fn to run after permissionRecheckInterval
+// unless bucket already has a recheck pending, in which case it's a no-op -
+// the already-scheduled run re-reads the bucket's current policy when it
+// fires, so whatever triggered this call is still covered.
+func (s *permissionRecheckScheduler) scheduleIfNotPending(bucket string, fn func()) {
+	s.mu.Lock()
+	if s.pending[bucket] {
+		s.mu.Unlock()
+		return
+	}
+	s.pending[bucket] = true
+	s.mu.Unlock()
+
+	time.AfterFunc(permissionRecheckInterval, func() {
+		s.mu.Lock()
+		delete(s.pending, bucket)
+		s.mu.Unlock()
+		fn()
+	})
+}
+
+// schedulePermissionRecheck re-applies a bucket's current policy translation
+// after permissionRecheckInterval, so statements gated on a condition key
+// that isn't satisfied yet (most commonly a future aws:CurrentTime bound)
+// eventually take effect instead of being silently dropped. At most one
+// recheck is ever pending per bucket; see permissionRecheckScheduler.
+func (api objectAPIHandlers) schedulePermissionRecheck(bucket string) {
+	globalPermissionRechecks.scheduleIfNotPending(bucket, func() {
+		ctx := context.Background()
+		bucketPolicy, err := globalPolicySys.Get(bucket)
+		if err != nil {
+			logger.Error("scheduled permission recheck: unable to reload bucket policy", zap.String("bucket", bucket), zap.Error(err))
+			return
+		}
+		// No revertDeltas: this is a forward re-apply of the bucket's current
+		// policy, not a diff against a prior one, so there's nothing to
+		// compensate back to if it doesn't fully succeed - it'll simply be
+		// retried by the next recheck. The audit event here has no actor or
+		// policy hashes - it wasn't triggered by a PutBucketPolicy call - just
+		// the bucket and the objects this recheck ends up touching.
+		audit := newPolicyAuditEvent(bucket, "")
+		api.startPolicyPermissionJob(audit, bucket, api.translateBucketPolicyToSaoPermissions(ctx, bucketPolicy, bucket), nil)
+	})
+}
+
+// maxWildcardResourceObjects bounds how many real objects a single wildcard
+// resource pattern (e.g. "bucket/*" or "bucket/public/*") expands to. It
+// bounds the matches, not the listing: the bucket is listed page by page
+// until that many objects match or the listing is exhausted.
+const maxWildcardResourceObjects = 10000
+
+// objectNamesFromResources extracts the bucket-relative object names a
+// statement's resources cover. Literal resources (no '*'/'?') are returned
+// as-is. A pattern containing a wildcard - most commonly "bucket/*", the
+// shape almost every real bucket policy uses to grant access to a whole
+// bucket - is expanded against the bucket's actual object list instead of
+// being passed through as a literal object named "*". The bucket ARN itself
+// (used by actions like s3:ListBucket) is skipped, since it has no
+// per-object SAO model.
+func objectNamesFromResources(ctx context.Context, api objectAPIHandlers, statement policy.Statement, bucket string) []string {
+	var objectNames []string
+	wildcardSeen := false
+
+	for resource := range statement.Resources {
+		objectName := resource.Pattern
+		if strings.Contains(objectName, "/") {
+			objectName = strings.SplitN(objectName, "/", 2)[1]
+		} else if objectName == bucket {
+			// Bucket-level resource, e.g. a bare s3:ListBucket grant - no
+			// per-object SAO model to touch.
+			continue
 		}
+
+		if strings.ContainsAny(objectName, "*?") {
+			wildcardSeen = true
+			continue
+		}
+		objectNames = append(objectNames, objectName)
 	}
-	return false
+
+	if !wildcardSeen {
+		return objectNames
+	}
+
+	if api.ObjectAPI == nil {
+		return objectNames
+	}
+	objAPI := api.ObjectAPI()
+	if objAPI == nil {
+		return objectNames
+	}
+	return append(objectNames, expandWildcardResourceObjects(ctx, objAPI, statement, bucket)...)
 }
 
-func difference(slice1, slice2 []string) []string {
-	var diff []string
-	for _, s1 := range slice1 {
-		found := false
-		for _, s2 := range slice2 {
-			if s1 == s2 {
-				found = true
-				break
+// expandWildcardResourceObjects lists bucket and returns every object whose
+// "bucket/key" matches at least one of statement's resource patterns, so a
+// wildcard resource actually resolves to the objects it covers. At most
+// maxWildcardResourceObjects matching objects are returned.
+func expandWildcardResourceObjects(ctx context.Context, objAPI ObjectLayer, statement policy.Statement, bucket string) []string {
+	var objectNames []string
+	marker := ""
+	for {
+		result, err := objAPI.ListObjects(ctx, bucket, "", marker, "", maxWildcardResourceObjects)
+		if err != nil {
+			logger.Error("expandWildcardResourceObjects: unable to list bucket objects", zap.String("bucket", bucket), zap.Error(err))
+			return objectNames
+		}
+
+		for _, obj := range result.Objects {
+			if statement.Resources.Match(bucket+"/"+obj.Name, nil) {
+				objectNames = append(objectNames, obj.Name)
 			}
 		}
-		if !found {
-			diff = append(diff, s1)
+
+		if len(objectNames) >= maxWildcardResourceObjects {
+			return objectNames[:maxWildcardResourceObjects]
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextMarker
+	}
+	return objectNames
+}
+
+// statementPrincipals returns the AWS principals (DIDs, wallet addresses, or
+// "*" for public) a statement names.
+func statementPrincipals(statement policy.Statement) []string {
+	principals := make([]string, 0, len(statement.Principal.AWS))
+	for principal := range statement.Principal.AWS {
+		principals = append(principals, principal)
+	}
+	return principals
+}
+
+// statementActionKinds reports whether a statement's actions grant read
+// access (s3:GetObject), write access (s3:PutObject, s3:DeleteObject), or
+// both. s3:ListBucket is read access at the bucket level and is handled
+// separately by objectNamesFromResources skipping the bucket resource.
+func statementActionKinds(statement policy.Statement) (read, write bool) {
+	if _, ok := statement.Actions[policy.GetObjectAction]; ok {
+		read = true
+	}
+	if _, ok := statement.Actions[policy.ListBucketAction]; ok {
+		read = true
+	}
+	if _, ok := statement.Actions[policy.PutObjectAction]; ok {
+		write = true
+	}
+	if _, ok := statement.Actions[policy.DeleteObjectAction]; ok {
+		write = true
+	}
+	return read, write
+}
+
+// diffPermissionDeltas returns, for every object whose grant changed between
+// the original and new policy, the delta that should be pushed to SAO. An
+// object present only in originalDeltas is reported with an empty delta so
+// its grant is revoked rather than left stale.
+func diffPermissionDeltas(newDeltas, originalDeltas map[string]*saoPermissionDelta) map[string]*saoPermissionDelta {
+	changed := map[string]*saoPermissionDelta{}
+
+	for objectName, d := range newDeltas {
+		if !permissionDeltaEqual(d, originalDeltas[objectName]) {
+			changed[objectName] = d
+		}
+	}
+	for objectName, d := range originalDeltas {
+		if _, stillGranted := newDeltas[objectName]; stillGranted {
+			continue
+		}
+		if !d.empty() {
+			changed[objectName] = &saoPermissionDelta{}
+		}
+	}
+
+	return changed
+}
+
+func permissionDeltaEqual(a, b *saoPermissionDelta) bool {
+	if a.empty() && b.empty() {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return a.public == b.public && stringSetEqual(a.readers, b.readers) && stringSetEqual(a.writers, b.writers)
+}
+
+func stringSetEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, v := range a {
+		seen[v] = true
+	}
+	for _, v := range b {
+		if !seen[v] {
+			return false
 		}
 	}
-	return diff
+	return true
+}
+
+func appendUnique(slice []string, value string) []string {
+	for _, v := range slice {
+		if v == value {
+			return slice
+		}
+	}
+	return append(slice, value)
+}
+
+func removeAll(slice []string, remove map[string]bool) []string {
+	if len(remove) == 0 {
+		return slice
+	}
+	kept := slice[:0]
+	for _, v := range slice {
+		if !remove[v] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func (api objectAPIHandlers) fetchSaoDataId(ctx context.Context, didManagerId, object, bucket string) (string, error) {
+	modelKey := fmt.Sprintf("%s-%s-%s", didManagerId, object, bucket)
+
+	// Call saoClient.GetModel() to get the dataId
+	modelResponse, err := api.SaoClient.GetModel(ctx, modelKey)
+	if err != nil {
+		logger.Error("Failed to fetch sao data Id", zap.String("modelKey", modelKey), zap.Error(err))
+		return "", err
+	}
+
+	// Return the dataId from the modelResponse
+	return modelResponse.Model.Data, nil
 }
 
 // DeleteBucketPolicyHandler - This HTTP handler removes bucket policy configuration.
@@ -341,6 +759,9 @@ func (api objectAPIHandlers) DeleteBucketPolicyHandler(w http.ResponseWriter, r
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
 
+	audit := newPolicyAuditEvent(bucket, actorDIDFromRequest(r))
+	defer audit.emit(ctx)
+
 	if s3Error := checkRequestAuthType(ctx, r, policy.DeleteBucketPolicyAction, bucket, ""); s3Error != ErrNone {
 		writeErrorResponse(ctx, w, errorCodes.ToAPIErr(s3Error), r.URL)
 		return
@@ -352,18 +773,17 @@ func (api objectAPIHandlers) DeleteBucketPolicyHandler(w http.ResponseWriter, r
 		return
 	}
 
-	updatedAt, err := globalBucketMetadataSys.Delete(ctx, bucket, bucketPolicyConfig)
-	if err != nil {
+	if effective, err := api.fetchEffectiveBucketPolicy(ctx, bucket); err == nil {
+		audit.SaoDataIDBefore = effective.SaoModelDataId
+		audit.PriorPolicyHash = hashPolicyBytes(effective.RawContent)
+	}
+
+	txn := newBucketPolicyTxn(api, bucket, false, "", nil)
+	if _, err := txn.commitDelete(ctx); err != nil {
 		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
 		return
 	}
-
-	// Call site replication hook.
-	logger.LogIf(ctx, globalSiteReplicationSys.BucketMetaHook(ctx, madmin.SRBucketMeta{
-		Type:      madmin.SRBucketMetaTypePolicy,
-		Bucket:    bucket,
-		UpdatedAt: updatedAt,
-	}))
+	audit.Outcome = "ok"
 
 	// Success.
 	writeSuccessNoContent(w)
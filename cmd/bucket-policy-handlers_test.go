@@ -0,0 +1,198 @@
+// Copyright (c) 2015-2021 MinIO, Inc.
+//
+// This file is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/minio/pkg/bucket/policy"
+)
+
+func mustParseBucketPolicy(t *testing.T, bucket, doc string) *policy.Policy {
+	t.Helper()
+	p, err := policy.ParseConfig(strings.NewReader(doc), bucket)
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	return p
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsLiteralObject(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"AWS": ["did:example:reader"]},
+			"Action": ["s3:GetObject", "s3:PutObject"],
+			"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+		}]
+	}`)
+
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	d, ok := deltas["report.csv"]
+	if !ok {
+		t.Fatalf("expected a delta for report.csv, got %v", deltas)
+	}
+	if d.public {
+		t.Error("expected a named-principal grant, not public")
+	}
+	if len(d.readers) != 1 || d.readers[0] != "did:example:reader" {
+		t.Errorf("readers = %v, want [did:example:reader]", d.readers)
+	}
+	if len(d.writers) != 1 || d.writers[0] != "did:example:reader" {
+		t.Errorf("writers = %v, want [did:example:reader]", d.writers)
+	}
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsWildcardResourceWithoutObjectLayer(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"AWS": ["did:example:reader"]},
+			"Action": ["s3:GetObject"],
+			"Resource": ["arn:aws:s3:::test-bucket/*"]
+		}]
+	}`)
+
+	// No ObjectLayer is registered in this unit test, so a wildcard resource
+	// can't be expanded against a real object list; it must not fall back to
+	// a literal delta keyed "*" the way it used to.
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	if _, ok := deltas["*"]; ok {
+		t.Fatalf("wildcard resource must never produce a literal \"*\" delta, got %v", deltas)
+	}
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsPublicPrincipal(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"AWS": ["*"]},
+			"Action": ["s3:GetObject"],
+			"Resource": ["arn:aws:s3:::test-bucket/public.txt"]
+		}]
+	}`)
+
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	d, ok := deltas["public.txt"]
+	if !ok || !d.public {
+		t.Fatalf("expected a public delta for public.txt, got %+v", d)
+	}
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsPublicPrincipalWaitsOnCondition(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"AWS": ["*"]},
+			"Action": ["s3:GetObject"],
+			"Resource": ["arn:aws:s3:::test-bucket/embargoed.txt"],
+			"Condition": {
+				"DateGreaterThan": {"aws:CurrentTime": "2099-01-01T00:00:00Z"}
+			}
+		}]
+	}`)
+
+	// The condition's time bound hasn't been reached, so this public grant
+	// must not be applied yet - it was previously checked only for named
+	// principals, letting a time-bounded public grant through immediately.
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	if d, ok := deltas["embargoed.txt"]; ok && d.public {
+		t.Fatalf("expected the not-yet-satisfied condition to withhold the public grant, got %+v", d)
+	}
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsConditionalDenyWaitsOnCondition(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Principal": {"AWS": ["did:example:reader"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+			},
+			{
+				"Effect": "Deny",
+				"Principal": {"AWS": ["did:example:reader"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"],
+				"Condition": {
+					"DateGreaterThan": {"aws:CurrentTime": "2099-01-01T00:00:00Z"}
+				}
+			}
+		]
+	}`)
+
+	// The Deny's condition hasn't been satisfied yet, so it must not
+	// override the Allow grant until it is.
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	d := deltas["report.csv"]
+	if d == nil || d.empty() {
+		t.Fatalf("expected the Allow grant to still stand while the Deny's condition is unmet, got %+v", d)
+	}
+}
+
+func TestTranslateBucketPolicyToSaoPermissionsDenyOverridesAllow(t *testing.T) {
+	const bucket = "test-bucket"
+	p := mustParseBucketPolicy(t, bucket, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Principal": {"AWS": ["*"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+			},
+			{
+				"Effect": "Deny",
+				"Principal": {"AWS": ["*"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::test-bucket/report.csv"]
+			}
+		]
+	}`)
+
+	var api objectAPIHandlers
+	deltas := api.translateBucketPolicyToSaoPermissions(context.Background(), p, bucket)
+
+	d := deltas["report.csv"]
+	if d == nil || !d.empty() {
+		t.Fatalf("expected an explicit Deny to clear the grant entirely, got %+v", d)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2015-2021 MinIO, Inc.
+//
+// This file is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio/internal/logger"
+	"github.com/minio/mux"
+	"github.com/minio/pkg/env"
+	"go.uber.org/zap"
+)
+
+const (
+	// EnvSaoPermissionWorkers overrides how many objects' worth of SAO
+	// permission calls updateObjectPermissions fans out concurrently.
+	EnvSaoPermissionWorkers = "MINIO_SAO_PERMISSION_WORKERS"
+
+	defaultSaoPermissionWorkers = 16
+
+	// Per-object SAO call retry/backoff before applyObjectPermission gives up
+	// on that object and reports it failed.
+	objectPermissionMaxAttempts   = 3
+	objectPermissionRetryInterval = 200 * time.Millisecond
+)
+
+// MultiError aggregates the independent per-object failures a
+// updateObjectPermissions worker pool run can produce into a single error
+// value, instead of callers only ever seeing the last one.
+type MultiError struct {
+	Errors []error
+}
+
+// Add records err, ignoring nil.
+func (m *MultiError) Add(err error) {
+	if err != nil {
+		m.Errors = append(m.Errors, err)
+	}
+}
+
+// ErrorOrNil returns m as an error, or nil if nothing was ever added - the
+// usual shape for "did this batch of work succeed".
+func (m *MultiError) ErrorOrNil() error {
+	if m == nil || len(m.Errors) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	switch len(m.Errors) {
+	case 0:
+		return ""
+	case 1:
+		return m.Errors[0].Error()
+	default:
+		msgs := make([]string, len(m.Errors))
+		for i, err := range m.Errors {
+			msgs[i] = err.Error()
+		}
+		return strconv.Itoa(len(m.Errors)) + " errors occurred: " + strings.Join(msgs, "; ")
+	}
+}
+
+// saoPermissionWorkerCount returns the configured worker pool size for
+// updateObjectPermissions, falling back to defaultSaoPermissionWorkers for an
+// unset or invalid value.
+func saoPermissionWorkerCount() int {
+	n, err := strconv.Atoi(env.Get(EnvSaoPermissionWorkers, strconv.Itoa(defaultSaoPermissionWorkers)))
+	if err != nil || n < 1 {
+		return defaultSaoPermissionWorkers
+	}
+	return n
+}
+
+// withObjectPermissionRetry calls fn up to objectPermissionMaxAttempts times,
+// sleeping a little longer between each attempt, and returns the last error
+// if none of them succeed.
+func withObjectPermissionRetry(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < objectPermissionMaxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < objectPermissionMaxAttempts-1 {
+			time.Sleep(objectPermissionRetryInterval * time.Duration(attempt+1))
+		}
+	}
+	return err
+}
+
+// policyJobObjectStatus is one object's outcome within a policyJob, as
+// reported to a client polling PolicyJobStatusHandler.
+type policyJobObjectStatus struct {
+	ObjectName string `json:"objectName"`
+	Status     string `json:"status"` // "ok" or "error"
+	Error      string `json:"error,omitempty"`
+}
+
+// policyJob tracks one background updateObjectPermissions fan-out started by
+// startPolicyPermissionJob, so a client handed its ID in the
+// X-Minio-Sao-Policy-Job-Id response header can poll
+// GET /minio/admin/v3/policy-jobs/{id} instead of the PutBucketPolicy request
+// blocking until every object is done.
+type policyJob struct {
+	mu sync.Mutex
+
+	ID        string    `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Status    string    `json:"status"` // "running", "done", or "error"
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt,omitempty"`
+
+	Objects []policyJobObjectStatus `json:"objects,omitempty"`
+}
+
+// snapshot returns a copy of j safe to marshal without racing a still-running
+// job's updates.
+func (j *policyJob) snapshot() policyJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	objects := make([]policyJobObjectStatus, len(j.Objects))
+	copy(objects, j.Objects)
+
+	return policyJob{
+		ID:        j.ID,
+		Bucket:    j.Bucket,
+		Status:    j.Status,
+		Error:     j.Error,
+		StartedAt: j.StartedAt,
+		EndedAt:   j.EndedAt,
+		Objects:   objects,
+	}
+}
+
+// policyJobStore is the process-local registry of in-flight and completed
+// policy permission jobs, keyed by ID.
+type policyJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*policyJob
+}
+
+var globalPolicyJobs = &policyJobStore{jobs: map[string]*policyJob{}}
+
+func (s *policyJobStore) add(j *policyJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = j
+}
+
+func (s *policyJobStore) get(id string) (*policyJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// startPolicyPermissionJob fans the SAO permission updates implied by deltas
+// out to a background goroutine via updateObjectPermissions' worker pool and
+// returns immediately with a job the caller can hand back to the client for
+// polling, instead of blocking the request on potentially thousands of SAO
+// round trips. revertDeltas, if non-nil, is the grant every object in deltas
+// had before this change; if the job doesn't end with every object applied
+// cleanly, compensatePermissionJob reverts whichever objects did change back
+// to it, so a partial failure can't leave the bucket's objects straddling
+// the old and new policy.
+//
+// audit is the policyAuditEvent for whatever triggered this job (a
+// PutBucketPolicy call, or a scheduled recheck with a bare bucket-only
+// event). Its Bucket/ActorDID/policy-hash/SAO-dataId fields are already
+// filled in by the caller; this job takes ownership of emitting it and does
+// so once Objects is known, so a bucket policy change's full history -
+// actor, before/after policy and SAO state, and every object's outcome -
+// lands in a single record instead of being split across two.
+func (api objectAPIHandlers) startPolicyPermissionJob(audit *policyAuditEvent, bucket string, deltas, revertDeltas map[string]*saoPermissionDelta) *policyJob {
+	job := &policyJob{
+		ID:        mustGetUUID(),
+		Bucket:    bucket,
+		Status:    "running",
+		StartedAt: time.Now().UTC(),
+	}
+	globalPolicyJobs.add(job)
+	audit.PermissionJobID = job.ID
+	audit.deferToJob = true
+
+	go func() {
+		ctx := context.Background()
+		changes, errs := api.updateObjectPermissions(ctx, bucket, deltas)
+
+		job.mu.Lock()
+		job.Objects = make([]policyJobObjectStatus, 0, len(changes))
+		for _, change := range changes {
+			status := policyJobObjectStatus{ObjectName: change.ObjectName, Status: "ok"}
+			if change.Outcome != "ok" {
+				status.Status = "error"
+				status.Error = change.Outcome
+			}
+			job.Objects = append(job.Objects, status)
+		}
+		job.EndedAt = time.Now().UTC()
+		if err := errs.ErrorOrNil(); err != nil {
+			job.Status = "error"
+			job.Error = err.Error()
+			api.compensatePermissionJob(ctx, bucket, changes, revertDeltas)
+			audit.Outcome = "error: " + job.Error
+		} else {
+			job.Status = "done"
+			audit.Outcome = "ok"
+		}
+		job.mu.Unlock()
+
+		audit.Objects = changes
+		audit.emit(ctx)
+	}()
+
+	return job
+}
+
+// compensatePermissionJob reverts every object updateObjectPermissions did
+// manage to change back to its pre-change grant (revertDeltas), because the
+// job as a whole didn't succeed - leaving those objects on the new policy's
+// grant while the objects that failed stay on the old one is exactly the
+// divergence a two-phase commit is supposed to prevent. Objects whose
+// change.Outcome isn't "ok" are left alone, including an object whose file_
+// model was updated before its _info model failed.
+func (api objectAPIHandlers) compensatePermissionJob(ctx context.Context, bucket string, changes []policyAuditObjectChange, revertDeltas map[string]*saoPermissionDelta) {
+	reverts := map[string]*saoPermissionDelta{}
+	for _, change := range changes {
+		if change.Outcome != "ok" {
+			continue
+		}
+		revert := revertDeltas[change.ObjectName]
+		if revert == nil {
+			revert = &saoPermissionDelta{}
+		}
+		reverts[change.ObjectName] = revert
+	}
+	if len(reverts) == 0 {
+		return
+	}
+
+	logger.Info("policy permission job failed, reverting successfully-applied objects to their prior grant",
+		zap.String("bucket", bucket), zap.Int("objects", len(reverts)))
+	if _, errs := api.updateObjectPermissions(ctx, bucket, reverts); errs.ErrorOrNil() != nil {
+		logger.Error("policy permission job compensation failed, some objects may be left on the new policy's grant",
+			zap.String("bucket", bucket), zap.Error(errs))
+	}
+}
+
+// PolicyJobStatusHandler - GET /minio/admin/v3/policy-jobs/{id}
+//
+// Returns the status of a background SAO permission fan-out started by
+// PutBucketPolicyHandler, including every object's individual outcome so a
+// client can poll completion instead of the original request hanging on
+// serial SAO calls.
+func (api objectAPIHandlers) PolicyJobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r, w, "PolicyJobStatus")
+
+	defer logger.AuditLog(ctx, w, r, mustGetClaimsFromToken(r))
+
+	vars := mux.Vars(r)
+	jobID := vars["id"]
+
+	job, ok := globalPolicyJobs.get(jobID)
+	if !ok {
+		writeErrorResponse(ctx, w, APIError{
+			Code:           "NoSuchPolicyJob",
+			HTTPStatusCode: http.StatusNotFound,
+			Description:    "no such policy job: " + jobID,
+		}, r.URL)
+		return
+	}
+
+	responseData, err := json.Marshal(job.snapshot())
+	if err != nil {
+		writeErrorResponse(ctx, w, toAPIError(ctx, err), r.URL)
+		return
+	}
+
+	writeSuccessResponseJSON(w, responseData)
+}
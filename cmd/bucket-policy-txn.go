@@ -0,0 +1,206 @@
+// Copyright (c) 2015-2021 MinIO, Inc.
+//
+// This file is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/madmin-go/v3"
+	"github.com/minio/minio/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// How long to wait before retrying a failed site-replication hook call.
+	policyReplicationRetryInterval = 30 * time.Second
+
+	// How many times to retry a failed site-replication hook call before
+	// giving up and just logging it.
+	maxPolicyReplicationRetries = 5
+)
+
+// bucketPolicyTxn stages a bucket-policy mutation across the three stores
+// PutBucketPolicyHandler touches - the SAO policy model, local bucket
+// metadata, and the site-replication hook - and commits them with
+// compensating rollback so a mid-way failure can't leave the stores
+// diverged: SAO has the new policy but local doesn't, or local has it but
+// replicas were never told. DeleteBucketPolicyHandler's commitDelete touches
+// only local metadata and the replication hook; it leaves the SAO policy
+// model as it is.
+//
+// The replication hook is treated differently from the other two: once the
+// SAO model and local metadata land, the policy change is committed, so a
+// replication failure doesn't unwind it - it's retried in-process up to
+// maxPolicyReplicationRetries times instead of being dropped. Pending
+// retries are not persisted and are lost if the process restarts.
+type bucketPolicyTxn struct {
+	api    objectAPIHandlers
+	bucket string
+
+	// saoModelExists/saoModelDataId describe the SAO model as it was found
+	// before this txn, so a local-metadata failure can revert it.
+	saoModelExists bool
+	saoModelDataId string
+
+	// priorConfigData is the SAO policy model's content before this txn,
+	// nil if no model existed yet; rollbackSaoModel restores it.
+	priorConfigData []byte
+}
+
+// newBucketPolicyTxn captures the state a rollback would need to restore
+// before any part of the mutation is applied.
+func newBucketPolicyTxn(api objectAPIHandlers, bucket string, saoModelExists bool, saoModelDataId string, priorConfigData []byte) *bucketPolicyTxn {
+	return &bucketPolicyTxn{
+		api:             api,
+		bucket:          bucket,
+		saoModelExists:  saoModelExists,
+		saoModelDataId:  saoModelDataId,
+		priorConfigData: priorConfigData,
+	}
+}
+
+// commitPut stages the SAO policy model create/update followed by the local
+// bucket metadata write, rolling the SAO model back to its prior version if
+// the local metadata write fails. Returns the time local metadata was
+// updated and the dataId the SAO model now lives at, for the caller's
+// response/audit trail.
+func (t *bucketPolicyTxn) commitPut(ctx context.Context, jsonData, bucketPolicyBytes []byte) (time.Time, string, error) {
+	dataId, err := t.commitSaoModel(ctx, jsonData)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("update sao policy model: %w", err)
+	}
+
+	updatedAt, err := globalBucketMetadataSys.Update(ctx, t.bucket, bucketPolicyConfig, jsonData)
+	if err != nil {
+		t.rollbackSaoModel(ctx, dataId)
+		return time.Time{}, "", fmt.Errorf("update local bucket metadata: %w", err)
+	}
+
+	t.replicate(madmin.SRBucketMeta{
+		Type:      madmin.SRBucketMetaTypePolicy,
+		Bucket:    t.bucket,
+		Policy:    bucketPolicyBytes,
+		UpdatedAt: updatedAt,
+	})
+
+	return updatedAt, dataId, nil
+}
+
+// commitDelete stages the local bucket metadata delete and the
+// site-replication hook, mirroring commitPut's ordering and retry
+// semantics.
+func (t *bucketPolicyTxn) commitDelete(ctx context.Context) (time.Time, error) {
+	updatedAt, err := globalBucketMetadataSys.Delete(ctx, t.bucket, bucketPolicyConfig)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("delete local bucket metadata: %w", err)
+	}
+
+	t.replicate(madmin.SRBucketMeta{
+		Type:      madmin.SRBucketMetaTypePolicy,
+		Bucket:    t.bucket,
+		UpdatedAt: updatedAt,
+	})
+
+	return updatedAt, nil
+}
+
+// commitSaoModel creates or updates the SAO policy model and returns the
+// dataId it now lives at.
+func (t *bucketPolicyTxn) commitSaoModel(ctx context.Context, jsonData []byte) (string, error) {
+	if !t.saoModelExists {
+		_, dataId, err := t.api.SaoClient.CreateModel(ctx, string(jsonData), t.bucket, 365, 30, "minio_bucket_policy", 1, false)
+		if err != nil {
+			return "", err
+		}
+		return dataId, nil
+	}
+
+	if err := t.api.SaoClient.UpdateModelQuick(ctx, t.saoModelDataId, jsonData, t.bucket, 365, 30, false, 1); err != nil {
+		if strings.Contains(err.Error(), "No differences found") {
+			logger.Info("No differences found, model not updated")
+		} else {
+			return "", err
+		}
+	}
+	return t.saoModelDataId, nil
+}
+
+// rollbackSaoModel reverts the SAO policy model to the version captured
+// when this txn started. If the model was newly created (no prior version
+// to revert to), SAO has no delete-model call to undo the creation with, so
+// this just logs the orphaned model for operator cleanup.
+func (t *bucketPolicyTxn) rollbackSaoModel(ctx context.Context, dataId string) {
+	if !t.saoModelExists {
+		logger.Error("bucketPolicyTxn: local metadata update failed after creating a new SAO policy model, leaving orphaned model in place",
+			zap.String("bucket", t.bucket), zap.String("dataId", dataId))
+		return
+	}
+
+	if err := t.api.SaoClient.UpdateModelQuick(ctx, dataId, t.priorConfigData, t.bucket, 365, 30, false, 1); err != nil {
+		logger.Error("bucketPolicyTxn: failed to roll back SAO policy model to its prior version",
+			zap.String("bucket", t.bucket), zap.Error(err))
+	}
+}
+
+// startPermissionJob hands the per-object SAO permission fan-out for this
+// txn's policy change to a background job, the way startPolicyPermissionJob
+// always has, but gives the txn a compensating action for it: revertDeltas
+// is the grant every object had before this policy change, and if the job
+// ends without every object applying cleanly, it's used to revert whichever
+// objects the job did manage to change back to their prior grant - so a
+// partial failure can't leave some objects on the new policy and others on
+// the old one, the same way commitPut's own rollback protects the policy
+// document itself. audit is the caller's in-flight policyAuditEvent for this
+// policy change; the job takes it over and emits it once Objects is known.
+func (t *bucketPolicyTxn) startPermissionJob(audit *policyAuditEvent, deltas, revertDeltas map[string]*saoPermissionDelta) *policyJob {
+	return t.api.startPolicyPermissionJob(audit, t.bucket, deltas, revertDeltas)
+}
+
+// replicate fires the site-replication hook and, if it fails, schedules
+// in-process retries (see scheduleReplicationRetry) instead of dropping the
+// notification - the policy change itself is already committed by this
+// point. The retries are not persisted across a restart.
+func (t *bucketPolicyTxn) replicate(meta madmin.SRBucketMeta) {
+	if err := globalSiteReplicationSys.BucketMetaHook(context.Background(), meta); err != nil {
+		logger.Error("bucketPolicyTxn: site replication hook failed, scheduling retry",
+			zap.String("bucket", t.bucket), zap.Error(err))
+		t.scheduleReplicationRetry(meta, 1)
+	}
+}
+
+func (t *bucketPolicyTxn) scheduleReplicationRetry(meta madmin.SRBucketMeta, attempt int) {
+	if attempt > maxPolicyReplicationRetries {
+		logger.Error("bucketPolicyTxn: giving up on site replication hook after repeated failures",
+			zap.String("bucket", t.bucket), zap.Int("attempts", attempt))
+		return
+	}
+
+	time.AfterFunc(policyReplicationRetryInterval, func() {
+		if err := globalSiteReplicationSys.BucketMetaHook(context.Background(), meta); err != nil {
+			logger.Error("bucketPolicyTxn: site replication retry failed",
+				zap.String("bucket", t.bucket), zap.Int("attempt", attempt), zap.Error(err))
+			t.scheduleReplicationRetry(meta, attempt+1)
+			return
+		}
+		logger.Info("bucketPolicyTxn: site replication retry succeeded",
+			zap.String("bucket", t.bucket), zap.Int("attempt", attempt))
+	})
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2015-2021 MinIO, Inc.
+//
+// This file is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio/internal/logger"
+	"github.com/minio/pkg/env"
+	"go.uber.org/zap"
+)
+
+const (
+	// EnvPolicyAuditLogPath overrides where the append-only policy audit log
+	// is written. SAO's UpdateModelQuick overwrites the previous policy
+	// version in place, so this file is the only place a bucket's full
+	// permission history survives.
+	EnvPolicyAuditLogPath = "MINIO_SAO_POLICY_AUDIT_LOG_PATH"
+
+	defaultPolicyAuditLogPath = "policy-audit.log"
+)
+
+// policyAuditObjectChange is one object's worth of SAO permission mutation
+// triggered by a bucket policy change, and how applying it went.
+type policyAuditObjectChange struct {
+	ObjectName      string              `json:"objectName"`
+	SaoDataID       string              `json:"saoDataId,omitempty"`
+	PermissionDelta *saoPermissionDelta `json:"permissionDelta,omitempty"`
+	Outcome         string              `json:"outcome"` // "ok" or the error text
+}
+
+// policyAuditEvent is one structured record of a bucket policy mutation:
+// the bucket, who did it, the before/after policy and SAO model identity,
+// and what happened to every affected object's SAO permissions.
+type policyAuditEvent struct {
+	Time time.Time `json:"time"`
+
+	Bucket   string `json:"bucket"`
+	ActorDID string `json:"actorDid,omitempty"`
+
+	PriorPolicyHash string `json:"priorPolicyHash,omitempty"`
+	NewPolicyHash   string `json:"newPolicyHash,omitempty"`
+
+	SaoDataIDBefore string `json:"saoDataIdBefore,omitempty"`
+	SaoDataIDAfter  string `json:"saoDataIdAfter,omitempty"`
+
+	Objects []policyAuditObjectChange `json:"objects,omitempty"`
+
+	// PermissionJobID, when set, is the id of the background job
+	// (startPolicyPermissionJob) that fanned Objects' SAO calls out
+	// concurrently. PolicyJobStatusHandler can still be polled for live
+	// status while the job runs, but the job itself owns emitting this
+	// event - see deferToJob - so the final record always carries both this
+	// id and the Objects it produced together.
+	PermissionJobID string `json:"permissionJobId,omitempty"`
+
+	// Outcome starts as "error" (see newPolicyAuditEvent) and is set to "ok"
+	// once the handler reaches success, so a deferred emit on an early-return
+	// path records "error". A background permission job that doesn't fully
+	// succeed sets it to "error: " followed by the job's error text.
+	Outcome string `json:"outcome"`
+
+	// deferToJob is set by startPolicyPermissionJob once it takes ownership
+	// of this event: emitUnlessDeferred becomes a no-op, and the job emits
+	// the single merged record itself after Objects is filled in, instead of
+	// the handler emitting a partial record here and the job emitting a
+	// second, differently-shaped one for the same change.
+	deferToJob bool
+}
+
+// newPolicyAuditEvent starts an event for bucket, defaulting Outcome to
+// "error" so a deferred emit on a path that returns early without setting it
+// still records that the request didn't succeed.
+func newPolicyAuditEvent(bucket, actorDID string) *policyAuditEvent {
+	return &policyAuditEvent{
+		Bucket:   bucket,
+		ActorDID: actorDID,
+		Outcome:  "error",
+	}
+}
+
+// actorDIDFromRequest pulls the caller's DID out of the request's JWT claims
+// for the policy audit trail.
+func actorDIDFromRequest(r *http.Request) string {
+	claims := mustGetClaimsFromToken(r)
+	if claims == nil {
+		return ""
+	}
+	did, _ := claims["sub"].(string)
+	return did
+}
+
+// hashPolicyBytes returns the hex sha256 of a policy document, or "" if data
+// is empty (no prior/new policy to hash).
+func hashPolicyBytes(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// tagRequestAuditInfo attaches this event's already-known fields to the
+// current request's ReqInfo, so the per-request audit log entry that
+// logger.AuditLog fires from the handler's own deferred call carries them
+// too. Objects isn't tagged here: it's only known once the background
+// permission job finishes, by which point this request has already
+// returned and its AuditLog entry already fired. That full per-object
+// record reaches the audit webhook separately, via sendToAuditWebhook, once
+// emit runs for the completed event.
+func (e *policyAuditEvent) tagRequestAuditInfo(ctx context.Context) {
+	reqInfo := logger.GetReqInfo(ctx)
+	if reqInfo == nil {
+		return
+	}
+	reqInfo.AppendTags("policyActorDid", e.ActorDID)
+	reqInfo.AppendTags("policyPriorHash", e.PriorPolicyHash)
+	reqInfo.AppendTags("policyNewHash", e.NewPolicyHash)
+	reqInfo.AppendTags("policySaoDataIdBefore", e.SaoDataIDBefore)
+	reqInfo.AppendTags("policySaoDataIdAfter", e.SaoDataIDAfter)
+	if e.PermissionJobID != "" {
+		reqInfo.AppendTags("policyPermissionJobId", e.PermissionJobID)
+	}
+}
+
+// emitUnlessDeferred is what PutBucketPolicyHandler defers. It emits
+// immediately, unless a background permission job has taken ownership of
+// this event (deferToJob), in which case the job emits the one merged
+// record itself once every object's outcome is known.
+func (e *policyAuditEvent) emitUnlessDeferred(ctx context.Context) {
+	if e.deferToJob {
+		return
+	}
+	e.emit(ctx)
+}
+
+// emit logs the event, sends it to the configured audit webhook targets,
+// and appends it to the local append-only audit log - the three places a
+// completed policy change needs to land.
+func (e *policyAuditEvent) emit(ctx context.Context) {
+	e.Time = time.Now().UTC()
+
+	logger.Info("policy audit event", zap.Any("policyAudit", e))
+	e.sendToAuditWebhook(ctx)
+
+	if err := appendPolicyAuditEvent(e); err != nil {
+		logger.Error("policy audit: failed to append to local audit log", zap.Error(err))
+	}
+}
+
+// webhookReqInfo builds the ReqInfo sendToAuditWebhook hands to
+// logger.AuditLog, carrying every field tagRequestAuditInfo attaches to a
+// live request's own audit entry, plus Objects - JSON-encoded, since
+// ReqInfo tags are flat strings - which tagRequestAuditInfo can never reach
+// in time.
+func (e *policyAuditEvent) webhookReqInfo() *logger.ReqInfo {
+	reqInfo := &logger.ReqInfo{
+		BucketName: e.Bucket,
+		API:        "PolicyAudit",
+	}
+	reqInfo.AppendTags("policyActorDid", e.ActorDID)
+	reqInfo.AppendTags("policyPriorHash", e.PriorPolicyHash)
+	reqInfo.AppendTags("policyNewHash", e.NewPolicyHash)
+	reqInfo.AppendTags("policySaoDataIdBefore", e.SaoDataIDBefore)
+	reqInfo.AppendTags("policySaoDataIdAfter", e.SaoDataIDAfter)
+	reqInfo.AppendTags("policyOutcome", e.Outcome)
+	if e.PermissionJobID != "" {
+		reqInfo.AppendTags("policyPermissionJobId", e.PermissionJobID)
+	}
+	if objects, err := json.Marshal(e.Objects); err == nil {
+		reqInfo.AppendTags("policyObjects", string(objects))
+	}
+	return reqInfo
+}
+
+// sendToAuditWebhook dispatches e through logger.AuditLog, the same call
+// every handler in this package defers, so the completed event - Objects
+// included - reaches whatever audit webhook targets are configured instead
+// of only the local log. There's no live request/response pair this long
+// after the triggering request returned, so it builds the minimal synthetic
+// pair AuditLog needs and carries everything else via ReqInfo.
+func (e *policyAuditEvent) sendToAuditWebhook(ctx context.Context) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	w := httptest.NewRecorder()
+	ctx = logger.SetReqInfo(ctx, e.webhookReqInfo())
+	logger.AuditLog(ctx, w, r, nil)
+}
+
+var (
+	policyAuditFileMu sync.Mutex
+	policyAuditFile   *os.File
+)
+
+func policyAuditLogPath() string {
+	return env.Get(EnvPolicyAuditLogPath, defaultPolicyAuditLogPath)
+}
+
+// appendPolicyAuditEvent appends one JSON line to the local audit log,
+// opening it lazily and keeping the handle open for the life of the
+// process.
+func appendPolicyAuditEvent(e *policyAuditEvent) error {
+	policyAuditFileMu.Lock()
+	defer policyAuditFileMu.Unlock()
+
+	if policyAuditFile == nil {
+		f, err := os.OpenFile(policyAuditLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		policyAuditFile = f
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = policyAuditFile.Write(line)
+	return err
+}